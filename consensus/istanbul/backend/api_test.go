@@ -0,0 +1,151 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/consensus/istanbul/validator"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// fakeChainReader is a minimal consensus.ChainHeaderReader backed by a fixed
+// set of headers, enough to drive api.go's GetSnapshot/GetSnapshotAtHash
+// without a real blockchain.
+type fakeChainReader struct {
+	current *types.Header
+	byHash  map[common.Hash]*types.Header
+	byNum   map[uint64]*types.Header // canonical chain only
+}
+
+func (f *fakeChainReader) Config() *params.ChainConfig              { return &params.ChainConfig{} }
+func (f *fakeChainReader) CurrentHeader() *types.Header             { return f.current }
+func (f *fakeChainReader) GetHeaderByNumber(n uint64) *types.Header { return f.byNum[n] }
+func (f *fakeChainReader) GetHeaderByHash(h common.Hash) *types.Header {
+	return f.byHash[h]
+}
+func (f *fakeChainReader) GetHeader(h common.Hash, n uint64) *types.Header { return f.byHash[h] }
+func (f *fakeChainReader) GetTd(h common.Hash, n uint64) *big.Int          { return nil }
+
+// TestAPIGetSnapshotAcrossFork builds two headers at the same height - one
+// canonical, one a discarded sidechain block - each with its own stored
+// snapshot, and confirms that GetSnapshot (by number), GetSnapshotAtHash and
+// GetValidatorsAtHash all agree on the canonical branch while the sidechain
+// snapshot stays independently addressable only by its own hash.
+func TestAPIGetSnapshotAcrossFork(t *testing.T) {
+	pp := &istanbul.ProposerPolicy{Id: istanbul.RoundRobin, By: istanbul.ValidatorSortByString()}
+
+	canonicalValidators := []common.Address{testAddress(0), testAddress(1), testAddress(2)}
+	sideValidators := []common.Address{testAddress(0), testAddress(1)}
+
+	// Differ in Extra so the two headers hash differently despite sharing a
+	// number, simulating a fork.
+	canonicalHeader := &types.Header{Number: big.NewInt(10), Extra: []byte("canonical")}
+	sideHeader := &types.Header{Number: big.NewInt(10), Extra: []byte("sidechain")}
+
+	db := memorydb.New()
+	cache := newSnapshotCache()
+
+	canonicalSnap := newSnapshot(30000, 10, canonicalHeader.Hash(), validator.NewSet(canonicalValidators, pp), 0)
+	sideSnap := newSnapshot(30000, 10, sideHeader.Hash(), validator.NewSet(sideValidators, pp), 0)
+	if err := canonicalSnap.store(db, cache); err != nil {
+		t.Fatalf("failed to store canonical snapshot: %v", err)
+	}
+	if err := sideSnap.store(db, cache); err != nil {
+		t.Fatalf("failed to store sidechain snapshot: %v", err)
+	}
+
+	chain := &fakeChainReader{
+		current: canonicalHeader,
+		byHash: map[common.Hash]*types.Header{
+			canonicalHeader.Hash(): canonicalHeader,
+			sideHeader.Hash():      sideHeader,
+		},
+		byNum: map[uint64]*types.Header{10: canonicalHeader},
+	}
+	api := &API{
+		chain:    chain,
+		istanbul: &Backend{config: &istanbul.Config{Epoch: 30000}, db: db, cache: cache},
+	}
+
+	byNumber, err := api.GetSnapshot(nil) // nil -> latest -> the canonical header
+	if err != nil {
+		t.Fatalf("GetSnapshot failed: %v", err)
+	}
+	byHash, err := api.GetSnapshotAtHash(canonicalHeader.Hash())
+	if err != nil {
+		t.Fatalf("GetSnapshotAtHash failed: %v", err)
+	}
+	if byNumber.Hash != byHash.Hash || byNumber.Number != byHash.Number {
+		t.Fatalf("GetSnapshot and GetSnapshotAtHash disagree on the canonical branch: %+v vs %+v", byNumber, byHash)
+	}
+
+	wantValidators := canonicalSnap.validators()
+	gotByNumber, err := api.GetValidators(nil)
+	if err != nil {
+		t.Fatalf("GetValidators failed: %v", err)
+	}
+	gotByHash, err := api.GetValidatorsAtHash(canonicalHeader.Hash())
+	if err != nil {
+		t.Fatalf("GetValidatorsAtHash failed: %v", err)
+	}
+	for i := range wantValidators {
+		if gotByNumber[i] != wantValidators[i] || gotByHash[i] != wantValidators[i] {
+			t.Fatalf("validator mismatch at %d: number=%s hash=%s want=%s", i, gotByNumber[i].Hex(), gotByHash[i].Hex(), wantValidators[i].Hex())
+		}
+	}
+
+	// The number-indexed RPCs never see the sidechain block at all, since
+	// only the canonical header is reachable through byNum/CurrentHeader.
+	sideGot, err := api.GetValidatorsAtHash(sideHeader.Hash())
+	if err != nil {
+		t.Fatalf("GetValidatorsAtHash(side) failed: %v", err)
+	}
+	if len(sideGot) != len(sideValidators) {
+		t.Fatalf("expected sidechain snapshot to keep its own validator set, got %d want %d", len(sideGot), len(sideValidators))
+	}
+	for i, addr := range sideValidators {
+		if sideGot[i] != addr {
+			t.Fatalf("sidechain validator mismatch at %d: got %s want %s", i, sideGot[i].Hex(), addr.Hex())
+		}
+	}
+}
+
+// TestAPIGetSnapshotUnknownBlock checks that both lookup paths return
+// errUnknownBlock, rather than panicking, when the chain doesn't know the
+// requested block.
+func TestAPIGetSnapshotUnknownBlock(t *testing.T) {
+	chain := &fakeChainReader{byHash: map[common.Hash]*types.Header{}, byNum: map[uint64]*types.Header{}}
+	api := &API{
+		chain:    chain,
+		istanbul: &Backend{config: &istanbul.Config{Epoch: 30000}, db: memorydb.New(), cache: newSnapshotCache()},
+	}
+
+	if _, err := api.GetSnapshotAtHash(common.Hash{0xff}); err != errUnknownBlock {
+		t.Fatalf("expected errUnknownBlock, got %v", err)
+	}
+	n := rpc.BlockNumber(123)
+	if _, err := api.GetSnapshot(&n); err != errUnknownBlock {
+		t.Fatalf("expected errUnknownBlock, got %v", err)
+	}
+}
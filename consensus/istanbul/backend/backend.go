@@ -0,0 +1,65 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/ethdb"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// Backend is the Istanbul consensus engine's view of its own chain state:
+// the config, database handle and snapshot cache that both header
+// verification and the RPC API in api.go need in order to answer questions
+// about validator governance at an arbitrary block. The rest of the engine
+// (block sealing, gossip, header verification) lives alongside this in the
+// full package and is out of scope here.
+type Backend struct {
+	config *istanbul.Config
+	db     ethdb.Database
+	cache  *lru.ARCCache // recently used snapshots, see newSnapshotCache
+}
+
+// snapshot returns the authorization snapshot already persisted for the
+// block identified by number and hash. Replaying headers forward from an
+// older checkpoint snapshot (the case where number/hash don't have one of
+// their own yet) is handled by the engine's header verification path, not by
+// this RPC-facing lookup.
+func (sb *Backend) snapshot(chain consensus.ChainHeaderReader, number uint64, hash common.Hash) (*Snapshot, error) {
+	snap, err := loadSnapshot(sb.config.Epoch, sb.config.VoteTTL, sb.db, sb.cache, hash)
+	if err != nil {
+		return nil, err
+	}
+	if snap.Number != number {
+		return nil, errUnknownBlock
+	}
+	return snap, nil
+}
+
+// createGenesisSnapshot builds and persists the snapshot for the genesis
+// block, carrying the engine's configured Epoch and VoteTTL into it so vote
+// expiry is active from the very first block.
+func (sb *Backend) createGenesisSnapshot(hash common.Hash, valSet istanbul.ValidatorSet) (*Snapshot, error) {
+	snap := genesisSnapshot(sb.config, hash, valSet)
+	if err := snap.store(sb.db, sb.cache); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
@@ -19,18 +19,43 @@ package backend
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+
+	lru "github.com/hashicorp/golang-lru"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
 	"github.com/ethereum/go-ethereum/consensus/istanbul/validator"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 const (
 	dbKeySnapshotPrefix = "istanbul-snapshot"
+
+	// inmemorySnapshots is the number of recent snapshots to keep decoded in
+	// memory so that repeated apply walks over the same ancestor snapshot
+	// don't have to re-decode it from the database.
+	inmemorySnapshots = 128
+
+	// snapshotRLPVersion is written as the first byte of every RLP-encoded
+	// snapshot blob, so the on-disk format can evolve without breaking
+	// loadSnapshot's ability to tell it apart from the legacy JSON encoding.
+	snapshotRLPVersion = byte(1)
 )
 
+// newSnapshotCache creates an in-memory cache of recently used snapshots,
+// keyed by block hash, to avoid repeatedly paying the RLP/JSON decode cost
+// for ancestors that are revisited while applying a chain of headers. Each
+// Backend owns its own cache (created alongside its database handle) so that
+// multiple chains/instances running in the same process can never serve a
+// hash collision from one another's snapshots.
+func newSnapshotCache() *lru.ARCCache {
+	cache, _ := lru.NewARC(inmemorySnapshots)
+	return cache
+}
+
 // Vote represents a single vote that an authorized validator made to modify the
 // list of authorizations.
 type Vote struct {
@@ -49,7 +74,8 @@ type Tally struct {
 
 // Snapshot is the state of the authorization voting at a given point in time.
 type Snapshot struct {
-	Epoch uint64 // The number of blocks after which to checkpoint and reset the pending votes
+	Epoch   uint64 // The number of blocks after which to checkpoint and reset the pending votes
+	VoteTTL uint64 // Number of blocks after which a pending vote expires, regardless of Epoch. Zero disables expiry (the pre-existing, epoch-only behavior). Populated from istanbul.Config by the backend when the snapshot is created.
 
 	Number uint64                   // Block number where the snapshot was created
 	Hash   common.Hash              // Block hash where the snapshot was created
@@ -61,50 +87,92 @@ type Snapshot struct {
 // newSnapshot create a new snapshot with the specified startup parameters. This
 // method does not initialize the set of recent validators, so only ever use if for
 // the genesis block.
-func newSnapshot(epoch uint64, number uint64, hash common.Hash, valSet istanbul.ValidatorSet) *Snapshot {
+func newSnapshot(epoch uint64, number uint64, hash common.Hash, valSet istanbul.ValidatorSet, voteTTL uint64) *Snapshot {
 	snap := &Snapshot{
-		Epoch:  epoch,
-		Number: number,
-		Hash:   hash,
-		ValSet: valSet,
-		Tally:  make(map[common.Address]Tally),
+		Epoch:   epoch,
+		VoteTTL: voteTTL,
+		Number:  number,
+		Hash:    hash,
+		ValSet:  valSet,
+		Tally:   make(map[common.Address]Tally),
 	}
 	return snap
 }
 
-// loadSnapshot loads an existing snapshot from the database.
-func loadSnapshot(epoch uint64, db ethdb.Database, hash common.Hash) (*Snapshot, error) {
+// genesisSnapshot builds the initial snapshot for the genesis block, carrying
+// forward the Epoch and VoteTTL configured on the Istanbul engine so that vote
+// expiry applies from block 1 onward, not just after the first checkpoint.
+func genesisSnapshot(config *istanbul.Config, hash common.Hash, valSet istanbul.ValidatorSet) *Snapshot {
+	return newSnapshot(config.Epoch, 0, hash, valSet, config.VoteTTL)
+}
+
+// loadSnapshot loads an existing snapshot from the database, preferring the
+// in-memory cache over a round-trip through the database whenever possible.
+// cache is the caller's (Backend's) own snapshot cache - see newSnapshotCache.
+// Like epoch, voteTTL always overrides whatever value was persisted with the
+// snapshot, so a config change takes effect on an already-running chain
+// instead of staying frozen at whatever was baked in at genesis.
+func loadSnapshot(epoch uint64, voteTTL uint64, db ethdb.Database, cache *lru.ARCCache, hash common.Hash) (*Snapshot, error) {
+	if cached, ok := cache.Get(hash); ok {
+		snap := cached.(*Snapshot).copy()
+		snap.Epoch = epoch
+		snap.VoteTTL = voteTTL
+		return snap, nil
+	}
 	blob, err := db.Get(append([]byte(dbKeySnapshotPrefix), hash[:]...))
 	if err != nil {
 		return nil, err
 	}
 	snap := new(Snapshot)
-	if err := json.Unmarshal(blob, snap); err != nil {
+	if isRLPEncodedSnapshot(blob) {
+		if err := snap.decodeRLP(blob); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(blob, snap); err != nil {
+		// Pre-upgrade databases only ever wrote JSON, so fall back to that
+		// whenever the blob doesn't carry our RLP version byte.
 		return nil, err
 	}
 	snap.Epoch = epoch
+	snap.VoteTTL = voteTTL
 
+	cache.Add(hash, snap.copy())
 	return snap, nil
 }
 
-// store inserts the snapshot into the database.
-func (s *Snapshot) store(db ethdb.Database) error {
-	blob, err := json.Marshal(s)
+// isRLPEncodedSnapshot reports whether blob looks like a snapshot written by
+// the RLP codec (store always prefixes it with snapshotRLPVersion), as
+// opposed to a legacy JSON-encoded blob (which always starts with '{').
+func isRLPEncodedSnapshot(blob []byte) bool {
+	return len(blob) > 0 && blob[0] == snapshotRLPVersion
+}
+
+// store inserts the snapshot into the database, always using the compact RLP
+// encoding; MarshalJSON/UnmarshalJSON remain in place for the RPC surface
+// only. The just-stored snapshot is also primed into cache, the caller's
+// (Backend's) own snapshot cache - see newSnapshotCache.
+func (s *Snapshot) store(db ethdb.Database, cache *lru.ARCCache) error {
+	blob, err := s.encodeRLP()
 	if err != nil {
 		return err
 	}
-	return db.Put(append([]byte(dbKeySnapshotPrefix), s.Hash[:]...), blob)
+	if err := db.Put(append([]byte(dbKeySnapshotPrefix), s.Hash[:]...), blob); err != nil {
+		return err
+	}
+	cache.Add(s.Hash, s.copy())
+	return nil
 }
 
 // copy creates a deep copy of the snapshot, though not the individual votes.
 func (s *Snapshot) copy() *Snapshot {
 	cpy := &Snapshot{
-		Epoch:  s.Epoch,
-		Number: s.Number,
-		Hash:   s.Hash,
-		ValSet: s.ValSet.Copy(),
-		Votes:  make([]*Vote, len(s.Votes)),
-		Tally:  make(map[common.Address]Tally),
+		Epoch:   s.Epoch,
+		VoteTTL: s.VoteTTL,
+		Number:  s.Number,
+		Hash:    s.Hash,
+		ValSet:  s.ValSet.Copy(),
+		Votes:   make([]*Vote, len(s.Votes)),
+		Tally:   make(map[common.Address]Tally),
 	}
 
 	for address, tally := range s.Tally {
@@ -158,6 +226,37 @@ func (s *Snapshot) uncast(address common.Address, authorize bool) bool {
 	return true
 }
 
+// expireVotes drops any pending vote cast more than VoteTTL blocks before
+// number, uncasting it from the tally so it no longer counts towards a
+// majority. It is a no-op when VoteTTL is zero, which preserves the
+// pre-existing epoch-only expiry semantics.
+func (s *Snapshot) expireVotes(number uint64) {
+	if s.VoteTTL == 0 {
+		return
+	}
+	for i := 0; i < len(s.Votes); i++ {
+		vote := s.Votes[i]
+		if vote.Block+s.VoteTTL < number {
+			s.uncast(vote.Address, vote.Authorize)
+			s.Votes = append(s.Votes[:i], s.Votes[i+1:]...)
+			i--
+		}
+	}
+}
+
+// resetOrExpireVotes clears every pending vote on a checkpoint block,
+// regardless of VoteTTL, otherwise expires only those votes older than
+// VoteTTL. It is shared by legacyApply and qbftApply, which only differ in
+// how they recover the header's signer and vote.
+func (s *Snapshot) resetOrExpireVotes(number uint64) {
+	if number%s.Epoch == 0 {
+		s.Votes = nil
+		s.Tally = make(map[common.Address]Tally)
+	} else {
+		s.expireVotes(number)
+	}
+}
+
 // apply creates a new authorization snapshot by applying the given headers to
 // the original one.
 func (s *Snapshot) apply(headers []*types.Header, isQBFTConsensus bool, qbftBlockNumber int64) (*Snapshot, error) {
@@ -197,12 +296,8 @@ func (s *Snapshot) apply(headers []*types.Header, isQBFTConsensus bool, qbftBloc
 }
 
 func (s *Snapshot) legacyApply(header *types.Header) error {
-	// Remove any votes on checkpoint blocks
 	number := header.Number.Uint64()
-	if number%s.Epoch == 0 {
-		s.Votes = nil
-		s.Tally = make(map[common.Address]Tally)
-	}
+	s.resetOrExpireVotes(number)
 	// Resolve the authorization key and check against validators
 	validator, err := ecrecoverFromSignedHeader(header)
 	if err != nil {
@@ -276,12 +371,8 @@ func (s *Snapshot) legacyApply(header *types.Header) error {
 // qbftApply creates a new authorization snapshot using qbftExtra by applying the given headers to
 // the original one.
 func (s *Snapshot) qbftApply(header *types.Header) error {
-	// Remove any votes on checkpoint blocks
 	number := header.Number.Uint64()
-	if number%s.Epoch == 0 {
-		s.Votes = nil
-		s.Tally = make(map[common.Address]Tally)
-	}
+	s.resetOrExpireVotes(number)
 	// Resolve the authorization key and check against validators
 	validator, err := ecrecoverFromCoinbase(header)
 	if err != nil {
@@ -382,11 +473,12 @@ func (s *Snapshot) validators() []common.Address {
 }
 
 type snapshotJSON struct {
-	Epoch  uint64                   `json:"epoch"`
-	Number uint64                   `json:"number"`
-	Hash   common.Hash              `json:"hash"`
-	Votes  []*Vote                  `json:"votes"`
-	Tally  map[common.Address]Tally `json:"tally"`
+	Epoch   uint64                   `json:"epoch"`
+	VoteTTL uint64                   `json:"voteTTL"`
+	Number  uint64                   `json:"number"`
+	Hash    common.Hash              `json:"hash"`
+	Votes   []*Vote                  `json:"votes"`
+	Tally   map[common.Address]Tally `json:"tally"`
 
 	// for validator set
 	Validators []common.Address          `json:"validators"`
@@ -396,6 +488,7 @@ type snapshotJSON struct {
 func (s *Snapshot) toJSONStruct() *snapshotJSON {
 	return &snapshotJSON{
 		Epoch:      s.Epoch,
+		VoteTTL:    s.VoteTTL,
 		Number:     s.Number,
 		Hash:       s.Hash,
 		Votes:      s.Votes,
@@ -413,6 +506,7 @@ func (s *Snapshot) UnmarshalJSON(b []byte) error {
 	}
 
 	s.Epoch = j.Epoch
+	s.VoteTTL = j.VoteTTL
 	s.Number = j.Number
 	s.Hash = j.Hash
 	s.Votes = j.Votes
@@ -429,3 +523,90 @@ func (s *Snapshot) MarshalJSON() ([]byte, error) {
 	j := s.toJSONStruct()
 	return json.Marshal(j)
 }
+
+// tallyEntry is the RLP-friendly representation of a single Tally map entry;
+// rlp has no native support for Go maps, so the on-disk encoding flattens
+// Snapshot.Tally into a slice of these. Tally.Votes is an int, which rlp
+// cannot encode, so the count is carried here as a uint64.
+type tallyEntry struct {
+	Address   common.Address
+	Authorize bool
+	Votes     uint64
+}
+
+// snapshotRLP is the RLP encoding of Snapshot, used for the on-disk format
+// only. It mirrors snapshotJSON, flattening the validator set the same way;
+// unlike snapshotJSON, it also flattens the vote tally into tallyEntry values.
+type snapshotRLP struct {
+	Epoch   uint64
+	VoteTTL uint64
+	Number  uint64
+	Hash    common.Hash
+	Votes   []*Vote
+	Tally   []tallyEntry
+
+	// for validator set
+	Validators []common.Address
+	Policy     istanbul.ProposerPolicyId
+}
+
+func (s *Snapshot) toRLPStruct() *snapshotRLP {
+	tally := make([]tallyEntry, 0, len(s.Tally))
+	for address, t := range s.Tally {
+		tally = append(tally, tallyEntry{Address: address, Authorize: t.Authorize, Votes: uint64(t.Votes)})
+	}
+	return &snapshotRLP{
+		Epoch:      s.Epoch,
+		VoteTTL:    s.VoteTTL,
+		Number:     s.Number,
+		Hash:       s.Hash,
+		Votes:      s.Votes,
+		Tally:      tally,
+		Validators: s.validators(),
+		Policy:     s.ValSet.Policy().Id,
+	}
+}
+
+func (s *Snapshot) fromRLPStruct(r *snapshotRLP) {
+	s.Epoch = r.Epoch
+	s.VoteTTL = r.VoteTTL
+	s.Number = r.Number
+	s.Hash = r.Hash
+	s.Votes = r.Votes
+
+	s.Tally = make(map[common.Address]Tally, len(r.Tally))
+	for _, entry := range r.Tally {
+		s.Tally[entry.Address] = Tally{Authorize: entry.Authorize, Votes: int(entry.Votes)}
+	}
+
+	// Setting the By function to ValidatorSortByStringFunc should be fine, as the validator do not change only the order changes
+	pp := &istanbul.ProposerPolicy{Id: r.Policy, By: istanbul.ValidatorSortByString()}
+	s.ValSet = validator.NewSet(r.Validators, pp)
+}
+
+// encodeRLP returns the compact on-disk encoding of the snapshot: a single
+// version byte followed by the RLP encoding of snapshotRLP.
+func (s *Snapshot) encodeRLP() ([]byte, error) {
+	enc, err := rlp.EncodeToBytes(s.toRLPStruct())
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{snapshotRLPVersion}, enc...), nil
+}
+
+// decodeRLP is the inverse of encodeRLP.
+func (s *Snapshot) decodeRLP(blob []byte) error {
+	if len(blob) == 0 {
+		return fmt.Errorf("istanbul: empty snapshot blob")
+	}
+	version, body := blob[0], blob[1:]
+	if version != snapshotRLPVersion {
+		return fmt.Errorf("istanbul: unsupported snapshot RLP version %d", version)
+	}
+	var r snapshotRLP
+	if err := rlp.DecodeBytes(body, &r); err != nil {
+		return err
+	}
+	s.fromRLPStruct(&r)
+	return nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/consensus/istanbul/validator"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// testAddress deterministically derives an address from an index, so test
+// data is reproducible without relying on randomness.
+func testAddress(i int) common.Address {
+	var addr common.Address
+	binary.BigEndian.PutUint32(addr[16:], uint32(i))
+	return addr
+}
+
+// bigSnapshot builds a snapshot with numValidators validators and numVotes
+// pending votes, representative of a long-lived checkpoint on a node with a
+// large validator set. hash lets each caller give its snapshot a distinct
+// identity, so unrelated test cases can't collide on the same cache/db key.
+func bigSnapshot(hash common.Hash, numValidators, numVotes int) *Snapshot {
+	pp := &istanbul.ProposerPolicy{Id: istanbul.RoundRobin, By: istanbul.ValidatorSortByString()}
+
+	validators := make([]common.Address, numValidators)
+	for i := range validators {
+		validators[i] = testAddress(i)
+	}
+	snap := newSnapshot(30000, 1000, hash, validator.NewSet(validators, pp), 0)
+
+	for i := 0; i < numVotes; i++ {
+		addr := testAddress(i)
+		snap.Votes = append(snap.Votes, &Vote{
+			Validator: validators[i%len(validators)],
+			Block:     uint64(1000 + i),
+			Address:   addr,
+			Authorize: i%2 == 0,
+		})
+	}
+	return snap
+}
+
+func TestSnapshotRLPRoundTrip(t *testing.T) {
+	snap := bigSnapshot(common.Hash{0x01}, 10, 20)
+
+	enc, err := snap.encodeRLP()
+	if err != nil {
+		t.Fatalf("failed to RLP encode snapshot: %v", err)
+	}
+	if !isRLPEncodedSnapshot(enc) {
+		t.Fatalf("encoded snapshot not recognized as RLP")
+	}
+
+	decoded := new(Snapshot)
+	if err := decoded.decodeRLP(enc); err != nil {
+		t.Fatalf("failed to RLP decode snapshot: %v", err)
+	}
+	if decoded.Number != snap.Number || decoded.Hash != snap.Hash || len(decoded.Votes) != len(snap.Votes) {
+		t.Fatalf("decoded snapshot mismatch: %+v vs %+v", decoded, snap)
+	}
+}
+
+func TestLoadSnapshotFallsBackToJSON(t *testing.T) {
+	snap := bigSnapshot(common.Hash{0x02}, 4, 4)
+	db := memorydb.New()
+	cache := newSnapshotCache()
+
+	// Simulate a pre-upgrade database that only ever wrote JSON.
+	blob, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("failed to JSON encode snapshot: %v", err)
+	}
+	if err := db.Put(append([]byte(dbKeySnapshotPrefix), snap.Hash[:]...), blob); err != nil {
+		t.Fatalf("failed to write legacy JSON blob: %v", err)
+	}
+
+	loaded, err := loadSnapshot(snap.Epoch, snap.VoteTTL, db, cache, snap.Hash)
+	if err != nil {
+		t.Fatalf("failed to load legacy JSON snapshot: %v", err)
+	}
+	if loaded.Number != snap.Number || loaded.Hash != snap.Hash {
+		t.Fatalf("legacy JSON snapshot mismatch: %+v vs %+v", loaded, snap)
+	}
+}
+
+func TestSnapshotStoreUsesRLPAndCache(t *testing.T) {
+	snap := bigSnapshot(common.Hash{0x03}, 4, 4)
+	db := memorydb.New()
+	cache := newSnapshotCache()
+
+	if err := snap.store(db, cache); err != nil {
+		t.Fatalf("failed to store snapshot: %v", err)
+	}
+
+	blob, err := db.Get(append([]byte(dbKeySnapshotPrefix), snap.Hash[:]...))
+	if err != nil {
+		t.Fatalf("failed to read back stored snapshot: %v", err)
+	}
+	if !isRLPEncodedSnapshot(blob) {
+		t.Fatalf("store did not write the RLP encoding")
+	}
+	if _, ok := cache.Get(snap.Hash); !ok {
+		t.Fatalf("store did not prime the in-memory cache")
+	}
+}
+
+// TestSnapshotCacheIsPerInstance checks that two independent caches (as two
+// Backend instances in the same process would each own, see
+// newSnapshotCache) never see each other's entries, even when, as here, they
+// happen to use the same hash.
+func TestSnapshotCacheIsPerInstance(t *testing.T) {
+	hash := common.Hash{0x04}
+	snapA := bigSnapshot(hash, 4, 4)
+	snapA.Number = 100
+	snapB := bigSnapshot(hash, 2, 0)
+	snapB.Number = 200
+
+	dbA, cacheA := memorydb.New(), newSnapshotCache()
+	dbB, cacheB := memorydb.New(), newSnapshotCache()
+
+	if err := snapA.store(dbA, cacheA); err != nil {
+		t.Fatalf("failed to store snapshot A: %v", err)
+	}
+	if err := snapB.store(dbB, cacheB); err != nil {
+		t.Fatalf("failed to store snapshot B: %v", err)
+	}
+
+	if _, ok := cacheA.Get(hash); !ok {
+		t.Fatalf("cache A missing its own entry")
+	}
+	if _, ok := cacheB.Get(hash); !ok {
+		t.Fatalf("cache B missing its own entry")
+	}
+
+	loadedA, err := loadSnapshot(snapA.Epoch, snapA.VoteTTL, dbA, cacheA, hash)
+	if err != nil {
+		t.Fatalf("failed to load snapshot A: %v", err)
+	}
+	if loadedA.Number != snapA.Number {
+		t.Fatalf("cache A served the wrong snapshot: got number %d, want %d", loadedA.Number, snapA.Number)
+	}
+
+	loadedB, err := loadSnapshot(snapB.Epoch, snapB.VoteTTL, dbB, cacheB, hash)
+	if err != nil {
+		t.Fatalf("failed to load snapshot B: %v", err)
+	}
+	if loadedB.Number != snapB.Number {
+		t.Fatalf("cache B served the wrong snapshot: got number %d, want %d", loadedB.Number, snapB.Number)
+	}
+}
+
+func BenchmarkSnapshotMarshalJSON(b *testing.B) {
+	snap := bigSnapshot(common.Hash{0x10}, 100, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(snap); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSnapshotUnmarshalJSON(b *testing.B) {
+	snap := bigSnapshot(common.Hash{0x10}, 100, 1000)
+	blob, err := json.Marshal(snap)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out := new(Snapshot)
+		if err := json.Unmarshal(blob, out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSnapshotEncodeRLP(b *testing.B) {
+	snap := bigSnapshot(common.Hash{0x10}, 100, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := snap.encodeRLP(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSnapshotDecodeRLP(b *testing.B) {
+	snap := bigSnapshot(common.Hash{0x10}, 100, 1000)
+	blob, err := snap.encodeRLP()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out := new(Snapshot)
+		if err := out.decodeRLP(blob); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/consensus/istanbul/validator"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+func newTestSnapshot(voteTTL uint64, addrs ...common.Address) *Snapshot {
+	pp := &istanbul.ProposerPolicy{Id: istanbul.RoundRobin, By: istanbul.ValidatorSortByString()}
+	return newSnapshot(30000, 0, common.Hash{}, validator.NewSet(addrs, pp), voteTTL)
+}
+
+// TestExpireVotesThenRecast checks that a vote older than VoteTTL is dropped
+// and its tally reverted, and that the same account can be voted on again
+// afterwards.
+func TestExpireVotesThenRecast(t *testing.T) {
+	v0, v1, v2 := testAddress(0), testAddress(1), testAddress(2)
+	candidate := testAddress(10)
+
+	snap := newTestSnapshot(5, v0, v1, v2)
+	snap.cast(candidate, true)
+	snap.Votes = append(snap.Votes, &Vote{Validator: v0, Block: 100, Address: candidate, Authorize: true})
+
+	// Not yet expired: 100 + 5 >= 104.
+	snap.expireVotes(104)
+	if len(snap.Votes) != 1 {
+		t.Fatalf("expected vote to survive, got %d votes", len(snap.Votes))
+	}
+
+	// Now past the TTL: 100 + 5 < 106.
+	snap.expireVotes(106)
+	if len(snap.Votes) != 0 {
+		t.Fatalf("expected vote to be expired, got %d votes", len(snap.Votes))
+	}
+	if _, ok := snap.Tally[candidate]; ok {
+		t.Fatalf("expired vote left a dangling tally entry")
+	}
+
+	// The account can be voted on again after expiry.
+	if !snap.cast(candidate, true) {
+		t.Fatalf("failed to re-cast vote for previously expired candidate")
+	}
+	snap.Votes = append(snap.Votes, &Vote{Validator: v1, Block: 110, Address: candidate, Authorize: true})
+	if tally := snap.Tally[candidate]; tally.Votes != 1 {
+		t.Fatalf("expected a fresh tally of 1, got %d", tally.Votes)
+	}
+}
+
+// TestExpireVotesWithValidatorRemoval checks that expiring a vote cast by a
+// validator that is removed shortly after leaves the snapshot in a
+// consistent state: no dangling tally entry, and the subsequent removal of
+// the voter's own stale votes (the loop istanbul runs when a removal vote
+// passes) does not re-encounter the already-expired entry.
+func TestExpireVotesWithValidatorRemoval(t *testing.T) {
+	v0, v1, v2 := testAddress(0), testAddress(1), testAddress(2)
+	candidate := testAddress(10)
+
+	snap := newTestSnapshot(5, v0, v1, v2)
+
+	// v0 votes for candidate at block 10; the vote is stale by block 20.
+	snap.cast(candidate, true)
+	snap.Votes = append(snap.Votes, &Vote{Validator: v0, Block: 10, Address: candidate, Authorize: true})
+	snap.expireVotes(20)
+
+	if len(snap.Votes) != 0 || len(snap.Tally) != 0 {
+		t.Fatalf("expected the stale vote and its tally to be gone, got votes=%d tally=%d", len(snap.Votes), len(snap.Tally))
+	}
+
+	// v0 is later removed from the validator set; replaying the cleanup loop
+	// that legacyApply/qbftApply run for a removed validator must be a no-op
+	// since expireVotes already cleared its vote.
+	snap.ValSet.RemoveValidator(v0)
+	for i := 0; i < len(snap.Votes); i++ {
+		if snap.Votes[i].Validator == v0 {
+			snap.uncast(snap.Votes[i].Address, snap.Votes[i].Authorize)
+			snap.Votes = append(snap.Votes[:i], snap.Votes[i+1:]...)
+			i--
+		}
+	}
+	if len(snap.Votes) != 0 || len(snap.Tally) != 0 {
+		t.Fatalf("removal cleanup should have been a no-op, got votes=%d tally=%d", len(snap.Votes), len(snap.Tally))
+	}
+}
+
+// TestExpireVotesDisabledByDefault checks that VoteTTL's zero value preserves
+// the pre-existing epoch-only expiry semantics: votes never expire on their
+// own, no matter how old they are.
+func TestExpireVotesDisabledByDefault(t *testing.T) {
+	v0 := testAddress(0)
+	candidate := testAddress(10)
+
+	snap := newTestSnapshot(0, v0)
+	snap.cast(candidate, true)
+	snap.Votes = append(snap.Votes, &Vote{Validator: v0, Block: 1, Address: candidate, Authorize: true})
+
+	snap.expireVotes(1_000_000)
+	if len(snap.Votes) != 1 {
+		t.Fatalf("expected vote to survive with VoteTTL disabled, got %d votes", len(snap.Votes))
+	}
+}
+
+// TestCheckpointResetClearsRegardlessOfVoteTTL checks that an epoch checkpoint
+// still wipes every pending vote outright, even a vote cast well within its
+// VoteTTL window - VoteTTL only ever shortens how long a vote can live, it
+// never delays the existing checkpoint reset.
+func TestCheckpointResetClearsRegardlessOfVoteTTL(t *testing.T) {
+	v0 := testAddress(0)
+	candidate := testAddress(10)
+
+	snap := newTestSnapshot(1_000_000, v0) // VoteTTL far longer than the epoch
+	snap.Epoch = 30000
+	snap.cast(candidate, true)
+	snap.Votes = append(snap.Votes, &Vote{Validator: v0, Block: 1, Address: candidate, Authorize: true})
+
+	snap.resetOrExpireVotes(30000) // checkpoint block
+	if len(snap.Votes) != 0 || len(snap.Tally) != 0 {
+		t.Fatalf("expected checkpoint reset to clear everything, got votes=%d tally=%d", len(snap.Votes), len(snap.Tally))
+	}
+}
+
+// TestGenesisSnapshotInheritsVoteTTLFromConfig checks that the genesis
+// snapshot carries the engine's configured VoteTTL, so expiry is active from
+// block 1 rather than only after a backend later sets it explicitly.
+func TestGenesisSnapshotInheritsVoteTTLFromConfig(t *testing.T) {
+	pp := &istanbul.ProposerPolicy{Id: istanbul.RoundRobin, By: istanbul.ValidatorSortByString()}
+	valSet := validator.NewSet([]common.Address{testAddress(0)}, pp)
+	config := &istanbul.Config{Epoch: 30000, VoteTTL: 256}
+
+	snap := genesisSnapshot(config, common.Hash{0x05}, valSet)
+	if snap.VoteTTL != config.VoteTTL {
+		t.Fatalf("genesis snapshot VoteTTL = %d, want %d", snap.VoteTTL, config.VoteTTL)
+	}
+	if snap.Epoch != config.Epoch {
+		t.Fatalf("genesis snapshot Epoch = %d, want %d", snap.Epoch, config.Epoch)
+	}
+	if snap.Number != 0 {
+		t.Fatalf("genesis snapshot Number = %d, want 0", snap.Number)
+	}
+}
+
+// TestLoadSnapshotOverridesStoredVoteTTL checks that, just like Epoch,
+// VoteTTL always comes from the caller's live config rather than whatever
+// was persisted with the snapshot - so an operator raising or lowering
+// VoteTTL in config takes effect immediately on an already-running chain,
+// on both the cache-hit and database-load paths.
+func TestLoadSnapshotOverridesStoredVoteTTL(t *testing.T) {
+	snap := newTestSnapshot(100, testAddress(0))
+	db, cache := memorydb.New(), newSnapshotCache()
+	if err := snap.store(db, cache); err != nil {
+		t.Fatalf("failed to store snapshot: %v", err)
+	}
+
+	const newVoteTTL = 999
+	reloaded, err := loadSnapshot(snap.Epoch, newVoteTTL, db, cache, snap.Hash)
+	if err != nil {
+		t.Fatalf("failed to load snapshot from cache: %v", err)
+	}
+	if reloaded.VoteTTL != newVoteTTL {
+		t.Fatalf("cache-hit load kept stored VoteTTL %d, want override %d", reloaded.VoteTTL, newVoteTTL)
+	}
+
+	cache.Remove(snap.Hash)
+	reloaded, err = loadSnapshot(snap.Epoch, newVoteTTL, db, cache, snap.Hash)
+	if err != nil {
+		t.Fatalf("failed to load snapshot from database: %v", err)
+	}
+	if reloaded.VoteTTL != newVoteTTL {
+		t.Fatalf("database load kept stored VoteTTL %d, want override %d", reloaded.VoteTTL, newVoteTTL)
+	}
+}